@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	cgi_prefix  = flag.String("cgi-prefix", "/cgi-bin/", "URL prefix routed to CGI scripts")
+	cgi_root    = flag.String("cgi-root", "", "Directory containing CGI scripts; CGI is disabled when empty")
+	cgi_timeout = flag.Duration("cgi-timeout", 10*time.Second, "How long a CGI script may run before being killed")
+)
+
+// handle_cgi implements RFC 3875 CGI/1.1: it maps the matched path under
+// *cgi_root to an executable, runs it with the standard CGI environment,
+// pipes the request body to its stdin, and streams its stdout back to
+// conn once the response headers have been parsed off it.
+func handle_cgi(conn net.Conn, request *Request, keep_alive bool) bool {
+	raw := request.PathParams["script"]
+	query_string := ""
+	if idx := strings.IndexByte(raw, '?'); idx != -1 {
+		query_string = raw[idx+1:]
+		raw = raw[:idx]
+	}
+
+	script_rel, path_info, ok := resolve_cgi_script(*cgi_root, raw)
+	if !ok {
+		write_status(conn, "404 Not Found", keep_alive)
+		return keep_alive
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *cgi_timeout)
+	defer cancel()
+
+	script_path, err := filepath.Abs(filepath.Join(*cgi_root, script_rel))
+	if err != nil {
+		write_status(conn, "502 Bad Gateway", keep_alive)
+		return keep_alive
+	}
+
+	cmd := exec.CommandContext(ctx, script_path)
+	cmd.Dir = filepath.Dir(script_path)
+	cmd.Env = cgi_environ(request, conn, script_rel, path_info, query_string)
+	cmd.Stdin = strings.NewReader(request.body)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		log.Printf("CGI script %s: failed to open stdout pipe: %s", script_rel, err)
+		write_status(conn, "502 Bad Gateway", keep_alive)
+		return keep_alive
+	}
+
+	if err := cmd.Start(); err != nil {
+		log.Printf("CGI script %s: failed to start: %s", script_rel, err)
+		write_status(conn, "502 Bad Gateway", keep_alive)
+		return keep_alive
+	}
+
+	reader := bufio.NewReader(stdout)
+	status, headers, err := parse_cgi_headers(reader)
+	if err != nil {
+		cancel()
+		cmd.Wait()
+		log.Printf("CGI script %s returned an unparsable response: %s", script_rel, err)
+		write_status(conn, "502 Bad Gateway", keep_alive)
+		return keep_alive
+	}
+
+	// Without an explicit Content-Length from the script we don't know
+	// where the body ends, so the connection can't safely be reused.
+	_, has_length := header_value(headers, "Content-Length")
+	response_keep_alive := keep_alive && has_length
+
+	var response []byte
+	response = append(response, fmt.Sprintf("HTTP/1.1 %s\r\n", status)...)
+	for _, header := range headers {
+		response = append(response, fmt.Sprintf("%s: %s\r\n", header.key, header.value)...)
+	}
+	response = append(response, fmt.Sprintf("Connection: %s\r\n\r\n", connection_header(response_keep_alive))...)
+	conn.Write(response)
+
+	if _, err := io.Copy(conn, reader); err != nil {
+		log.Printf("CGI script %s: error streaming response body: %s", script_rel, err)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			log.Printf("CGI script %s timed out and was killed", script_rel)
+		} else {
+			log.Printf("CGI script %s exited with an error: %s: %s", script_rel, err, stderr.String())
+		}
+	}
+
+	return response_keep_alive
+}
+
+// resolve_cgi_script walks the "/"-separated components of a matched
+// path looking for the longest prefix that names a file (not a
+// directory) under root, treating anything after it as PATH_INFO; the
+// execute bit is not checked here. This lets a CGI
+// script receive extra path segments the way a real CGI server does.
+func resolve_cgi_script(root string, matched string) (script_rel string, path_info string, ok bool) {
+	if root == "" || strings.Contains(matched, "..") {
+		return "", "", false
+	}
+
+	parts := strings.Split(strings.Trim(matched, "/"), "/")
+	for i := len(parts); i >= 1; i-- {
+		candidate := strings.Join(parts[:i], "/")
+		info, err := os.Stat(filepath.Join(root, candidate))
+		if err != nil || info.IsDir() {
+			continue
+		}
+
+		return candidate, strings.Join(parts[i:], "/"), true
+	}
+
+	return "", "", false
+}
+
+// cgi_environ builds the CGI/1.1 environment for a single request, per
+// RFC 3875 §4.1, translating request headers to HTTP_* variables.
+func cgi_environ(request *Request, conn net.Conn, script_rel string, path_info string, query_string string) []string {
+	env := []string{
+		"GATEWAY_INTERFACE=CGI/1.1",
+		"SERVER_PROTOCOL=" + request.http_version,
+		"REQUEST_METHOD=" + request.method,
+		"SCRIPT_NAME=" + path.Join(*cgi_prefix, script_rel),
+		"QUERY_STRING=" + query_string,
+	}
+
+	if path_info != "" {
+		env = append(env, "PATH_INFO=/"+path_info)
+	}
+
+	if host, port, err := net.SplitHostPort(conn.LocalAddr().String()); err == nil {
+		env = append(env, "SERVER_NAME="+host, "SERVER_PORT="+port)
+	}
+	if remote, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		env = append(env, "REMOTE_ADDR="+remote)
+	}
+
+	if content_type, err := request.try_get_header("Content-Type"); err == nil {
+		env = append(env, "CONTENT_TYPE="+content_type)
+	}
+	env = append(env, "CONTENT_LENGTH="+strconv.Itoa(len(request.body)))
+
+	for _, header := range request.headers {
+		if header.key == "Content-Type" || header.key == "Content-Length" {
+			continue
+		}
+
+		name := "HTTP_" + strings.ToUpper(strings.ReplaceAll(header.key, "-", "_"))
+		env = append(env, name+"="+header.value)
+	}
+
+	return env
+}
+
+// parse_cgi_headers reads CGI response headers up to the blank line
+// that separates them from the body, translating a `Status:` header
+// into the HTTP status line and defaulting to 200 OK when absent.
+func parse_cgi_headers(reader *bufio.Reader) (string, []Header, error) {
+	status := "200 OK"
+	headers := []Header{}
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+
+		header, err := try_parse_header(line)
+		if err != nil {
+			return "", nil, err
+		}
+
+		if strings.EqualFold(header.key, "Status") {
+			status = header.value
+			continue
+		}
+
+		headers = append(headers, header)
+	}
+
+	return status, headers, nil
+}
+
+func header_value(headers []Header, key string) (string, bool) {
+	for _, header := range headers {
+		if strings.EqualFold(header.key, key) {
+			return header.value, true
+		}
+	}
+
+	return "", false
+}
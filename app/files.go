@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// http_time_format is the RFC 7231 IMF-fixdate layout used by
+// Last-Modified/If-Modified-Since.
+const http_time_format = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+type byte_range struct {
+	start int64
+	end   int64 // inclusive
+}
+
+// handle_get_file serves /files/{name} with support for conditional
+// GETs (If-None-Match/If-Modified-Since) and Range requests. It runs as
+// a raw handler so it can io.CopyN straight from the file to conn
+// instead of buffering the whole file in memory for the 206/304 cases,
+// where raw byte offsets into the file are what the response is about.
+// The plain full-file 200 still goes through the same Accept-Encoding
+// negotiation as every other route, per chunk0-1.
+func handle_get_file(directory string, conn net.Conn, request *Request, keep_alive bool) bool {
+	filename := request.PathParams["name"]
+	if strings.Contains(filename, "..") {
+		write_status(conn, "404 Not Found", keep_alive)
+		return keep_alive
+	}
+
+	file, err := os.Open(directory + "/" + filename)
+	if err != nil {
+		write_status(conn, "404 Not Found", keep_alive)
+		return keep_alive
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		write_status(conn, "500 Internal Server Error", keep_alive)
+		return keep_alive
+	}
+
+	etag := file_etag(info)
+
+	if if_none_match, err := request.try_get_header("If-None-Match"); err == nil {
+		if if_none_match == "*" || etag_matches(if_none_match, etag) {
+			write_not_modified(conn, etag, info.ModTime(), keep_alive)
+			return keep_alive
+		}
+	} else if if_modified_since, err := request.try_get_header("If-Modified-Since"); err == nil {
+		if since, err := time.Parse(http_time_format, if_modified_since); err == nil {
+			if !info.ModTime().Truncate(time.Second).After(since) {
+				write_not_modified(conn, etag, info.ModTime(), keep_alive)
+				return keep_alive
+			}
+		}
+	}
+
+	if range_header, err := request.try_get_header("Range"); err == nil {
+		ranges, well_formed := parse_ranges(range_header, info.Size())
+		if well_formed {
+			if len(ranges) == 0 {
+				write_range_not_satisfiable(conn, info.Size(), keep_alive)
+				return keep_alive
+			}
+
+			serve_ranges(conn, file, info, ranges, keep_alive)
+			return keep_alive
+		}
+		// A syntactically invalid Range header is ignored, per RFC 7233 §2.1.
+	}
+
+	accept_encoding, _ := request.try_get_header("Accept-Encoding")
+	serve_full_file(conn, file, info, etag, accept_encoding, keep_alive)
+	return keep_alive
+}
+
+func file_etag(info os.FileInfo) string {
+	return fmt.Sprintf("\"%d-%d\"", info.Size(), info.ModTime().Unix())
+}
+
+func etag_matches(if_none_match string, etag string) bool {
+	for _, candidate := range strings.Split(if_none_match, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// parse_ranges parses a `Range: bytes=...` value into the (clamped,
+// unsatisfiable-filtered) byte ranges it names. ok is false when the
+// header isn't a "bytes" range or is syntactically malformed, in which
+// case it should be ignored entirely rather than rejected.
+func parse_ranges(header string, size int64) (ranges []byte_range, ok bool) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return nil, false
+	}
+
+	for _, spec := range strings.Split(strings.TrimPrefix(header, prefix), ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		dash := strings.IndexByte(spec, '-')
+		if dash == -1 {
+			return nil, false
+		}
+
+		start_str, end_str := spec[:dash], spec[dash+1:]
+
+		var start, end int64
+		if start_str == "" {
+			suffix_length, err := strconv.ParseInt(end_str, 10, 64)
+			if err != nil || suffix_length < 0 {
+				return nil, false
+			}
+			if suffix_length == 0 {
+				continue
+			}
+			if suffix_length > size {
+				suffix_length = size
+			}
+			start, end = size-suffix_length, size-1
+		} else {
+			s, err := strconv.ParseInt(start_str, 10, 64)
+			if err != nil || s < 0 {
+				return nil, false
+			}
+			start = s
+
+			if end_str == "" {
+				end = size - 1
+			} else {
+				e, err := strconv.ParseInt(end_str, 10, 64)
+				if err != nil || e < start {
+					return nil, false
+				}
+				end = e
+				if end > size-1 {
+					end = size - 1
+				}
+			}
+		}
+
+		if size == 0 || start >= size || start > end {
+			continue
+		}
+
+		ranges = append(ranges, byte_range{start: start, end: end})
+	}
+
+	return ranges, true
+}
+
+func write_not_modified(conn net.Conn, etag string, mod_time time.Time, keep_alive bool) {
+	conn.Write([]byte(fmt.Sprintf(
+		"HTTP/1.1 304 Not Modified\r\nETag: %s\r\nLast-Modified: %s\r\nConnection: %s\r\n\r\n",
+		etag, mod_time.UTC().Format(http_time_format), connection_header(keep_alive),
+	)))
+}
+
+func write_range_not_satisfiable(conn net.Conn, size int64, keep_alive bool) {
+	conn.Write([]byte(fmt.Sprintf(
+		"HTTP/1.1 416 Range Not Satisfiable\r\nContent-Range: bytes */%d\r\nContent-Length: 0\r\nConnection: %s\r\n\r\n",
+		size, connection_header(keep_alive),
+	)))
+}
+
+// serve_full_file writes the plain 200 response for a GET with no Range
+// and no matched conditional header. It negotiates Accept-Encoding the
+// same way every other route does: identity streams straight from the
+// file with io.CopyN, gzip has to buffer and compress first so it can
+// report a correct Content-Length.
+func serve_full_file(conn net.Conn, file *os.File, info os.FileInfo, etag string, accept_encoding string, keep_alive bool) {
+	encoding, ok := negotiate_encoding(accept_encoding)
+	if !ok {
+		write_status(conn, "406 Not Acceptable", keep_alive)
+		return
+	}
+
+	if encoding != "gzip" {
+		conn.Write([]byte(fmt.Sprintf(
+			"HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nContent-Length: %d\r\nAccept-Ranges: bytes\r\nETag: %s\r\nLast-Modified: %s\r\nConnection: %s\r\n\r\n",
+			info.Size(), etag, info.ModTime().UTC().Format(http_time_format), connection_header(keep_alive),
+		)))
+		io.CopyN(conn, file, info.Size())
+		return
+	}
+
+	content := make([]byte, info.Size())
+	if _, err := io.ReadFull(file, content); err != nil {
+		write_status(conn, "500 Internal Server Error", keep_alive)
+		return
+	}
+
+	encoded, err := encode_body(content, encoding)
+	if err != nil {
+		write_status(conn, "500 Internal Server Error", keep_alive)
+		return
+	}
+
+	conn.Write([]byte(fmt.Sprintf(
+		"HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nContent-Encoding: gzip\r\nContent-Length: %d\r\nAccept-Ranges: bytes\r\nETag: %s\r\nLast-Modified: %s\r\nConnection: %s\r\n\r\n",
+		len(encoded), etag, info.ModTime().UTC().Format(http_time_format), connection_header(keep_alive),
+	)))
+	conn.Write(encoded)
+}
+
+func serve_ranges(conn net.Conn, file *os.File, info os.FileInfo, ranges []byte_range, keep_alive bool) {
+	if len(ranges) == 1 {
+		serve_single_range(conn, file, info, ranges[0], keep_alive)
+		return
+	}
+
+	serve_multiple_ranges(conn, file, info, ranges, keep_alive)
+}
+
+func serve_single_range(conn net.Conn, file *os.File, info os.FileInfo, r byte_range, keep_alive bool) {
+	length := r.end - r.start + 1
+
+	conn.Write([]byte(fmt.Sprintf(
+		"HTTP/1.1 206 Partial Content\r\nContent-Type: application/octet-stream\r\nContent-Range: bytes %d-%d/%d\r\nContent-Length: %d\r\nAccept-Ranges: bytes\r\nConnection: %s\r\n\r\n",
+		r.start, r.end, info.Size(), length, connection_header(keep_alive),
+	)))
+
+	file.Seek(r.start, io.SeekStart)
+	io.CopyN(conn, file, length)
+}
+
+func serve_multiple_ranges(conn net.Conn, file *os.File, info os.FileInfo, ranges []byte_range, keep_alive bool) {
+	boundary := fmt.Sprintf("%016x", time.Now().UnixNano())
+
+	part_headers := make([]string, len(ranges))
+	var body_length int64
+	for i, r := range ranges {
+		part_headers[i] = fmt.Sprintf(
+			"--%s\r\nContent-Type: application/octet-stream\r\nContent-Range: bytes %d-%d/%d\r\n\r\n",
+			boundary, r.start, r.end, info.Size(),
+		)
+		body_length += int64(len(part_headers[i])) + (r.end - r.start + 1) + int64(len("\r\n"))
+	}
+	closing := fmt.Sprintf("--%s--\r\n", boundary)
+	body_length += int64(len(closing))
+
+	conn.Write([]byte(fmt.Sprintf(
+		"HTTP/1.1 206 Partial Content\r\nContent-Type: multipart/byteranges; boundary=%s\r\nContent-Length: %d\r\nAccept-Ranges: bytes\r\nConnection: %s\r\n\r\n",
+		boundary, body_length, connection_header(keep_alive),
+	)))
+
+	for i, r := range ranges {
+		conn.Write([]byte(part_headers[i]))
+		file.Seek(r.start, io.SeekStart)
+		io.CopyN(conn, file, r.end-r.start+1)
+		conn.Write([]byte("\r\n"))
+	}
+	conn.Write([]byte(closing))
+}
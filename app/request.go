@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
 )
@@ -12,6 +16,7 @@ type Request struct {
 	http_version string
 	headers      []Header
 	body         string
+	PathParams   map[string]string
 }
 
 type Header struct {
@@ -19,6 +24,16 @@ type Header struct {
 	value string
 }
 
+// max_body_size bounds how much of a request body (plain or chunked)
+// we'll buffer in memory before giving up with a 413.
+const max_body_size = 10 * 1024 * 1024 // 10 MiB
+
+var (
+	ErrBadRequest      = errors.New("bad request")
+	ErrLengthRequired  = errors.New("length required")
+	ErrRequestTooLarge = errors.New("request entity too large")
+)
+
 // Parses a header from a string. Returns an error if the header is invalid.
 func try_parse_header(line string) (Header, error) {
 	parts := strings.Split(line, ": ")
@@ -29,51 +44,157 @@ func try_parse_header(line string) (Header, error) {
 	return Header{key: parts[0], value: parts[1]}, nil
 }
 
-func parse_request(request_ []byte) (Request, error) {
-	request := string(request_)
-	lines := strings.Split(request, "\r\n")
-	if len(lines) < 1 {
-		return Request{}, fmt.Errorf("Invalid request")
+// parse_request reads a single HTTP request off reader, so it can be
+// called repeatedly against the same connection to support keep-alive.
+// Errors are one of the Err* sentinels above when the request itself is
+// malformed, or the underlying read_line error (typically io.EOF or a
+// deadline timeout) when the client didn't send a full request.
+func parse_request(reader *bufio.Reader) (Request, error) {
+	request_line, err := read_line(reader)
+	if err != nil {
+		return Request{}, err
 	}
 
-	request_line := strings.Split(lines[0], " ")
-	if len(request_line) != 3 {
-		return Request{}, fmt.Errorf("Invalid request line: %s", lines[0])
+	parts := strings.Split(request_line, " ")
+	if len(parts) != 3 {
+		return Request{}, ErrBadRequest
 	}
 
 	headers := []Header{}
-	for _, line := range lines[1:] {
+	for {
+		line, err := read_line(reader)
+		if err != nil {
+			return Request{}, err
+		}
 		if line == "" {
 			break
 		}
+
 		header, err := try_parse_header(line)
 		if err != nil {
-			return Request{}, err
+			return Request{}, ErrBadRequest
 		}
 		headers = append(headers, header)
 	}
 
-	body := ""
-
-	content_length_str, _ := try_get_headers(headers, "Content-Length")
-	content_length, err := strconv.Atoi(content_length_str)
+	if method_expects_body(parts[0]) {
+		_, missing_length := try_get_headers(headers, "Content-Length")
+		transfer_encoding, _ := try_get_headers(headers, "Transfer-Encoding")
+		if missing_length != nil && !strings.EqualFold(transfer_encoding, "chunked") {
+			return Request{}, ErrLengthRequired
+		}
+	}
 
-	if err == nil {
-		header_offset := 1 + len(headers)
-		remaining_lines := lines[header_offset:]
-		body = strings.Join(remaining_lines, "")
-		body = body[:content_length]
+	body, err := read_body(reader, headers)
+	if err != nil {
+		return Request{}, err
 	}
 
 	return Request{
-		method:       request_line[0],
-		path:         request_line[1],
-		http_version: request_line[2],
+		method:       parts[0],
+		path:         parts[1],
+		http_version: parts[2],
 		headers:      headers,
 		body:         body,
 	}, nil
 }
 
+// read_line reads a single CRLF-terminated line, with the line ending
+// stripped, so callers never have to special-case "\r\n" vs "\n".
+func read_line(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func method_expects_body(method string) bool {
+	switch method {
+	case "POST", "PUT", "PATCH":
+		return true
+	default:
+		return false
+	}
+}
+
+// read_body reads the request body according to Transfer-Encoding and
+// Content-Length, returning "" when neither header is present.
+func read_body(reader *bufio.Reader, headers []Header) (string, error) {
+	transfer_encoding, _ := try_get_headers(headers, "Transfer-Encoding")
+	if strings.EqualFold(transfer_encoding, "chunked") {
+		return read_chunked_body(reader)
+	}
+
+	content_length_str, err := try_get_headers(headers, "Content-Length")
+	if err != nil {
+		return "", nil
+	}
+
+	content_length, err := strconv.Atoi(content_length_str)
+	if err != nil || content_length < 0 {
+		return "", ErrBadRequest
+	}
+	if content_length > max_body_size {
+		return "", ErrRequestTooLarge
+	}
+
+	body := make([]byte, content_length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return "", err
+	}
+
+	return string(body), nil
+}
+
+// read_chunked_body decodes a `Transfer-Encoding: chunked` body: each
+// chunk is a hex size line, the chunk data, then a trailing CRLF, until
+// a zero-length chunk is followed by optional trailers and a blank line.
+func read_chunked_body(reader *bufio.Reader) (string, error) {
+	var body bytes.Buffer
+
+	for {
+		size_line, err := read_line(reader)
+		if err != nil {
+			return "", err
+		}
+		size_line = strings.TrimSpace(strings.SplitN(size_line, ";", 2)[0])
+
+		size, err := strconv.ParseInt(size_line, 16, 64)
+		if err != nil || size < 0 {
+			return "", ErrBadRequest
+		}
+
+		if size == 0 {
+			for {
+				line, err := read_line(reader)
+				if err != nil {
+					return "", err
+				}
+				if line == "" {
+					break
+				}
+			}
+			break
+		}
+
+		if int64(body.Len())+size > max_body_size {
+			return "", ErrRequestTooLarge
+		}
+
+		if _, err := io.CopyN(&body, reader, size); err != nil {
+			return "", err
+		}
+
+		if _, err := read_line(reader); err != nil {
+			return "", err
+		}
+	}
+
+	return body.String(), nil
+}
+
 func (request *Request) try_get_header(key string) (string, error) {
 	for _, header := range request.headers {
 		if header.key == key {
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HandlerFunc handles a single matched request, writing its response
+// through w instead of formatting raw bytes onto the connection.
+type HandlerFunc func(w ResponseWriter, request *Request)
+
+// Middleware wraps a HandlerFunc to run logic before/after it; mux.Use
+// registers these in the order they should run.
+type Middleware func(HandlerFunc) HandlerFunc
+
+// ResponseWriter buffers a handler's status, headers and body so the
+// mux can apply content-encoding negotiation and fill in Content-Length
+// and Connection once the handler is done, instead of each handler
+// formatting its own response.
+type ResponseWriter interface {
+	SetHeader(key, value string)
+	WriteStatus(status string)
+	Write(data []byte) (int, error)
+}
+
+type responseBuffer struct {
+	status  string
+	headers []Header
+	body    []byte
+}
+
+func new_response_buffer() *responseBuffer {
+	return &responseBuffer{status: "200 OK"}
+}
+
+func (w *responseBuffer) SetHeader(key, value string) {
+	for i, header := range w.headers {
+		if header.key == key {
+			w.headers[i].value = value
+			return
+		}
+	}
+	w.headers = append(w.headers, Header{key: key, value: value})
+}
+
+func (w *responseBuffer) WriteStatus(status string) {
+	w.status = status
+}
+
+func (w *responseBuffer) Write(data []byte) (int, error) {
+	w.body = append(w.body, data...)
+	return len(data), nil
+}
+
+func (w *responseBuffer) has_header(key string) bool {
+	for _, header := range w.headers {
+		if header.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// RawHandlerFunc handles a matched request directly against the
+// connection, bypassing ResponseWriter buffering. It reports whether
+// the connection should be kept alive, letting a handler downgrade a
+// keep-alive connection to close (e.g. when it can't supply a
+// Content-Length up front).
+type RawHandlerFunc func(conn net.Conn, request *Request, keep_alive bool) bool
+
+type muxRoute struct {
+	method  string
+	regex   *regexp.Regexp
+	handler HandlerFunc
+	raw     RawHandlerFunc
+}
+
+// ServeMux is a pattern-based request router modeled on net/http.ServeMux:
+// routes are registered once via Handle and compiled once, rather than
+// rebuilt per request.
+type ServeMux struct {
+	routes      []*muxRoute
+	middlewares []Middleware
+}
+
+func NewServeMux() *ServeMux {
+	return &ServeMux{}
+}
+
+// Use registers middleware that wraps every buffered handler dispatched
+// through this mux (those registered with Handle, plus the 404 fallback),
+// in registration order (first registered runs outermost). Handlers
+// registered with HandleRaw are not wrapped.
+func (mux *ServeMux) Use(middleware Middleware) {
+	mux.middlewares = append(mux.middlewares, middleware)
+}
+
+// Handle registers handler for method and pattern. Patterns may contain
+// `{name}` segments (e.g. "/echo/{msg}") whose matched text is exposed
+// via Request.PathParams at dispatch time.
+func (mux *ServeMux) Handle(method string, pattern string, handler HandlerFunc) {
+	mux.routes = append(mux.routes, &muxRoute{
+		method:  method,
+		regex:   compile_pattern(pattern),
+		handler: handler,
+	})
+}
+
+// HandleRaw registers a route whose handler writes directly to the
+// connection instead of through a buffered ResponseWriter, for handlers
+// that need to stream a response (e.g. CGI scripts). An empty method
+// matches any request method.
+func (mux *ServeMux) HandleRaw(method string, pattern string, handler RawHandlerFunc) {
+	mux.routes = append(mux.routes, &muxRoute{
+		method: method,
+		regex:  compile_pattern(pattern),
+		raw:    handler,
+	})
+}
+
+// compile_pattern turns a "{name}" path pattern into an anchored regex
+// with a named capture group per path parameter.
+func compile_pattern(pattern string) *regexp.Regexp {
+	var builder strings.Builder
+	builder.WriteByte('^')
+
+	for i := 0; i < len(pattern); {
+		if pattern[i] == '{' {
+			end := strings.IndexByte(pattern[i:], '}')
+			if end == -1 {
+				builder.WriteString(regexp.QuoteMeta(pattern[i:]))
+				break
+			}
+
+			name := pattern[i+1 : i+end]
+			builder.WriteString(fmt.Sprintf("(?P<%s>.*)", name))
+			i += end + 1
+			continue
+		}
+
+		next := strings.IndexByte(pattern[i:], '{')
+		if next == -1 {
+			builder.WriteString(regexp.QuoteMeta(pattern[i:]))
+			break
+		}
+		builder.WriteString(regexp.QuoteMeta(pattern[i : i+next]))
+		i += next
+	}
+
+	builder.WriteByte('$')
+	return regexp.MustCompile(builder.String())
+}
+
+func not_found_handler(w ResponseWriter, request *Request) {
+	w.WriteStatus("404 Not Found")
+}
+
+// route_for finds the first route matching request's method and path,
+// populating Request.PathParams from the pattern's named groups. An
+// empty route.method matches any request method.
+func (mux *ServeMux) route_for(request *Request) *muxRoute {
+	for _, route := range mux.routes {
+		if route.method != "" && route.method != request.method {
+			continue
+		}
+
+		match := route.regex.FindStringSubmatch(request.path)
+		if match == nil {
+			continue
+		}
+
+		request.PathParams = map[string]string{}
+		for i, name := range route.regex.SubexpNames() {
+			if i == 0 || name == "" {
+				continue
+			}
+			request.PathParams[name] = match[i]
+		}
+
+		return route
+	}
+
+	return nil
+}
+
+func (mux *ServeMux) chain(handler HandlerFunc) HandlerFunc {
+	for i := len(mux.middlewares) - 1; i >= 0; i-- {
+		handler = mux.middlewares[i](handler)
+	}
+	return handler
+}
+
+// ServeConn dispatches request to its matching route and writes the
+// response to conn, negotiating encoding and filling in
+// Content-Length/Connection automatically for buffered handlers. It
+// returns whether the connection should be kept alive, which a raw
+// handler may downgrade from the keep_alive it was given.
+func (mux *ServeMux) ServeConn(conn net.Conn, request *Request, keep_alive bool) bool {
+	route := mux.route_for(request)
+
+	if route != nil && route.raw != nil {
+		return route.raw(conn, request, keep_alive)
+	}
+
+	handler := not_found_handler
+	if route != nil {
+		handler = route.handler
+	}
+	handler = mux.chain(handler)
+
+	writer := new_response_buffer()
+	handler(writer, request)
+
+	flush_response(conn, writer, request, keep_alive)
+	return keep_alive
+}
+
+// negotiate_encoding picks the best supported content-coding from a
+// comma-separated `Accept-Encoding` header value, honoring q-values and
+// falling back to "identity" when nothing acceptable is offered. ok is
+// false when the client has explicitly rejected every supported coding
+// (RFC 7231 §5.3.4), in which case the caller must respond 406 rather
+// than silently falling back to identity.
+func negotiate_encoding(accept_encoding string) (encoding string, ok bool) {
+	type candidate struct {
+		name string
+		q    float64
+	}
+
+	supported := map[string]bool{"gzip": true, "identity": true}
+
+	if strings.TrimSpace(accept_encoding) == "" {
+		return "identity", true
+	}
+
+	candidates := []candidate{}
+	explicit := map[string]bool{}
+	star_rejected := false
+	for _, part := range strings.Split(accept_encoding, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name := part
+		q := 1.0
+
+		if idx := strings.Index(part, ";"); idx != -1 {
+			name = strings.TrimSpace(part[:idx])
+			for _, param := range strings.Split(part[idx+1:], ";") {
+				param = strings.TrimSpace(param)
+				if value, found := strings.CutPrefix(param, "q="); found {
+					if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+						q = parsed
+					}
+				}
+			}
+		}
+
+		candidates = append(candidates, candidate{name: name, q: q})
+		// A coding is "explicitly listed" regardless of its q-value: per
+		// RFC 7231 §5.3.4, "*" only matches codings not explicitly listed
+		// elsewhere, even if the explicit entry has q=0.
+		if name != "*" {
+			explicit[name] = true
+		} else if q <= 0 {
+			star_rejected = true
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].q > candidates[j].q
+	})
+
+	for _, c := range candidates {
+		if c.q <= 0 {
+			continue
+		}
+
+		if c.name == "*" {
+			for _, coding := range []string{"gzip", "identity"} {
+				if !explicit[coding] {
+					return coding, true
+				}
+			}
+			continue
+		}
+
+		if supported[c.name] {
+			return c.name, true
+		}
+	}
+
+	if explicit["identity"] || star_rejected {
+		// identity was either explicitly listed and, to have reached here,
+		// must have had q<=0, or was left unlisted under "*;q=0" — an
+		// explicit rejection of every supported coding.
+		return "", false
+	}
+
+	return "identity", true
+}
+
+// encode_body applies the negotiated content-coding to a response body.
+func encode_body(content []byte, encoding string) ([]byte, error) {
+	if encoding != "gzip" {
+		return content, nil
+	}
+
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(content); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// flush_response negotiates an encoding against request's Accept-Encoding,
+// encodes writer's buffered body, and writes a complete HTTP response
+// with a correct Content-Length to conn.
+func flush_response(conn net.Conn, writer *responseBuffer, request *Request, keep_alive bool) {
+	accept_encoding, _ := request.try_get_header("Accept-Encoding")
+	encoding, ok := negotiate_encoding(accept_encoding)
+	if !ok {
+		write_status(conn, "406 Not Acceptable", keep_alive)
+		return
+	}
+
+	body, err := encode_body(writer.body, encoding)
+	if err != nil {
+		write_status(conn, "500 Internal Server Error", keep_alive)
+		return
+	}
+
+	var response []byte
+	response = append(response, fmt.Sprintf("HTTP/1.1 %s\r\n", writer.status)...)
+	for _, header := range writer.headers {
+		response = append(response, fmt.Sprintf("%s: %s\r\n", header.key, header.value)...)
+	}
+	if encoding == "gzip" && !writer.has_header("Content-Encoding") {
+		response = append(response, "Content-Encoding: gzip\r\n"...)
+	}
+	response = append(response, fmt.Sprintf("Content-Length: %d\r\n", len(body))...)
+	response = append(response, fmt.Sprintf("Connection: %s\r\n\r\n", connection_header(keep_alive))...)
+	response = append(response, body...)
+
+	conn.Write(response)
+}
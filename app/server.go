@@ -1,33 +1,40 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
-	"regexp"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 type Server struct {
-	listener  net.Listener
-	directory string
-	signals   chan os.Signal
-	done      chan bool
-}
-
-type Route struct {
-	method  string
-	pattern string
-	handler func(inputs []string)
+	listener         net.Listener
+	directory        string
+	read_timeout     time.Duration
+	queue_timeout    time.Duration
+	shutdown_timeout time.Duration
+	mux              *ServeMux
+	conn_slots       chan struct{}
+	inflight         sync.WaitGroup
+	signals          chan os.Signal
+	done             chan bool
 }
 
 var (
-	listen    = flag.String("address", ":4221", "The address to listen on")
-	directory = flag.String("directory", "/tmp", "The directory to serve files from")
+	listen           = flag.String("address", ":4221", "The address to listen on")
+	directory        = flag.String("directory", "/tmp", "The directory to serve files from")
+	read_timeout     = flag.Duration("read-timeout", 30*time.Second, "How long to wait for a request before closing an idle connection")
+	max_conns        = flag.Int("max-conns", 100, "Maximum number of connections handled at once")
+	queue_timeout    = flag.Duration("queue-timeout", 5*time.Second, "How long an accepted connection waits for a free slot before getting a 503")
+	shutdown_timeout = flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for in-flight connections to drain during shutdown")
 )
 
 func main() {
@@ -40,11 +47,16 @@ func main() {
 	}
 
 	server := Server{
-		listener:  listener,
-		directory: *directory,
-		signals:   make(chan os.Signal, 1),
-		done:      make(chan bool, 1),
+		listener:         listener,
+		directory:        *directory,
+		read_timeout:     *read_timeout,
+		queue_timeout:    *queue_timeout,
+		shutdown_timeout: *shutdown_timeout,
+		conn_slots:       make(chan struct{}, *max_conns),
+		signals:          make(chan os.Signal, 1),
+		done:             make(chan bool, 1),
 	}
+	server.mux = build_routes(&server)
 
 	signal.Notify(server.signals, syscall.SIGINT, syscall.SIGKILL, syscall.SIGTERM)
 
@@ -56,13 +68,95 @@ func main() {
 	log.Println("Exiting program.")
 }
 
+// build_routes registers every endpoint this server exposes on a fresh
+// ServeMux. Called once at startup so patterns are compiled a single time.
+func build_routes(server *Server) *ServeMux {
+	mux := NewServeMux()
+
+	mux.Handle("GET", "/", func(w ResponseWriter, request *Request) {
+		w.WriteStatus("200 OK")
+	})
+
+	mux.Handle("GET", "/user-agent", func(w ResponseWriter, request *Request) {
+		user_agent, err := request.try_get_header("User-Agent")
+		if err != nil {
+			w.WriteStatus("400 Bad Request")
+			return
+		}
+
+		w.SetHeader("Content-Type", "text/plain")
+		w.Write([]byte(user_agent))
+	})
+
+	mux.Handle("GET", "/echo/{msg}", func(w ResponseWriter, request *Request) {
+		w.SetHeader("Content-Type", "text/plain")
+		w.Write([]byte(request.PathParams["msg"]))
+	})
+
+	mux.HandleRaw("GET", "/files/{name}", func(conn net.Conn, request *Request, keep_alive bool) bool {
+		return handle_get_file(server.directory, conn, request, keep_alive)
+	})
+
+	mux.Handle("POST", "/files/{name}", func(w ResponseWriter, request *Request) {
+		filename := request.PathParams["name"]
+		if strings.Contains(filename, "..") {
+			w.WriteStatus("404 Not Found")
+			return
+		}
+
+		file, err := os.Create(server.directory + "/" + filename)
+		if err != nil {
+			w.WriteStatus("500 Internal Server Error")
+			return
+		}
+		defer file.Close()
+
+		n, err := file.Write([]byte(request.body))
+		if err != nil {
+			w.WriteStatus("500 Internal Server Error")
+			return
+		}
+
+		log.Printf("Written %d bytes to %s", n, filename)
+		w.WriteStatus("201 Created")
+	})
+
+	if *cgi_root != "" {
+		mux.HandleRaw("", strings.TrimSuffix(*cgi_prefix, "/")+"/{script}", handle_cgi)
+	}
+
+	return mux
+}
+
+// handle_signals closes the listener on interrupt so accept_connection
+// stops taking new work, then waits (up to shutdown_timeout) for
+// in-flight connections to drain before signalling done.
 func (server *Server) handle_signals() {
 	<-server.signals
 	log.Println("Received interrupt, shutting down...")
 	server.listener.Close()
+
+	drained := make(chan struct{})
+	go func() {
+		server.inflight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		log.Println("All connections drained.")
+	case <-time.After(server.shutdown_timeout):
+		log.Println("Shutdown timeout exceeded, exiting with connections still in flight.")
+	}
+
 	server.done <- true
 }
 
+// accept_connection accepts connections as fast as the kernel hands them
+// over; each one waits for its own slot out of a fixed-size pool in its
+// own goroutine, so a saturated pool never blocks Accept() from cycling.
+// inflight is incremented here, before the slot wait, so shutdown drains
+// connections still queued for a slot instead of only ones already running.
 func (server *Server) accept_connection() {
 	for {
 		conn, err := server.listener.Accept()
@@ -75,133 +169,92 @@ func (server *Server) accept_connection() {
 			continue
 		}
 
-		go server.handle_connection(conn)
+		server.inflight.Add(1)
+		go server.serve_with_slot(conn)
+	}
+}
+
+// serve_with_slot waits up to queue_timeout for a free slot out of the
+// connection pool before giving up on conn with a 503, then runs it.
+func (server *Server) serve_with_slot(conn net.Conn) {
+	defer server.inflight.Done()
+
+	select {
+	case server.conn_slots <- struct{}{}:
+		defer func() { <-server.conn_slots }()
+		server.handle_connection(conn)
+	case <-time.After(server.queue_timeout):
+		write_status(conn, "503 Service Unavailable", false)
+		conn.Close()
 	}
 }
 
+// handle_connection streams one request at a time off conn with a
+// bufio.Reader, dispatching each to the mux and looping for HTTP/1.1
+// keep-alive until the client (or we) ask to close the connection.
 func (server *Server) handle_connection(conn net.Conn) {
 	defer conn.Close()
 
-	buffer := make([]byte, 4086)
-	_, err := conn.Read(buffer)
-	if err != nil {
-		fmt.Println("Error reading request: ", err.Error())
-		os.Exit(1)
-	}
+	reader := bufio.NewReader(conn)
 
-	request, err := parse_request(buffer)
-	if err != nil {
-		fmt.Println("Error parsing request: ", err.Error())
-		os.Exit(1)
+	for {
+		conn.SetReadDeadline(time.Now().Add(server.read_timeout))
+
+		request, err := parse_request(reader)
+		if err != nil {
+			server.handle_parse_error(conn, err)
+			return
+		}
+
+		keep_alive := server.mux.ServeConn(conn, &request, should_keep_alive(request))
+
+		if !keep_alive {
+			return
+		}
 	}
+}
 
-	mux := []Route{
-		{
-			method:  "GET",
-			pattern: "^/$",
-			handler: func(inputs []string) {
-				conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
-			},
-		},
-		{
-			method:  "GET",
-			pattern: "^/user-agent$",
-			handler: func(inputs []string) {
-				user_agent, err := request.try_get_header("User-Agent")
-				if err != nil {
-					conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
-					return
-				}
-				conn.Write([]byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: %d\r\n\r\n%s", len(user_agent), user_agent)))
-			},
-		},
-		{
-			method:  "GET",
-			pattern: "^/echo/(.*)$",
-			handler: func(inputs []string) {
-				content := inputs[1]
-
-				accept_encoding, _ := request.try_get_header("Accept-Encoding")
-
-				var response []byte
-				response = append(response, "HTTP/1.1 200 OK\r\n"...)
-				response = append(response, "Content-Type: text/plain\r\n"...)
-				if strings.Contains(accept_encoding, "gzip") {
-					response = append(response, "Content-Encoding: gzip\r\n"...)
-				}
-				response = append(response, fmt.Sprintf("Content-Length: %d\r\n\r\n", len(content))...)
-				response = append(response, content...)
-
-				conn.Write(response)
-			},
-		},
-		{
-			method:  "GET",
-			pattern: "^/files/(.*)$",
-			handler: func(inputs []string) {
-				filepath := inputs[1]
-
-				file, err := os.Open(server.directory + "/" + filepath)
-				if err != nil {
-					conn.Write([]byte("HTTP/1.1 404 Not Found\r\n\r\n"))
-					return
-				}
-
-				file_info, err := file.Stat()
-				if err != nil {
-					conn.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n\r\n"))
-					return
-				}
-				file_content := make([]byte, file_info.Size())
-				_, err = file.Read(file_content)
-				if err != nil {
-					conn.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n\r\n"))
-					return
-				}
-
-				conn.Write([]byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nContent-Length: %d\r\n\r\n%s", file_info.Size(), string(file_content))))
-			},
-		},
-		{
-			method:  "POST",
-			pattern: "^/files/(.*)$",
-			handler: func(inputs []string) {
-				filename := inputs[1]
-
-				file, err := os.Create(server.directory + "/" + filename)
-				if err != nil {
-					conn.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n\r\n"))
-					return
-				}
-
-				log.Println(len(request.body))
-				n, err := file.Write([]byte(request.body))
-				if err != nil {
-					conn.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n\r\n"))
-					return
-				}
-
-				log.Printf("Written %d bytes to %s", n, filename)
-
-				conn.Write([]byte("HTTP/1.1 201 Created\r\n\r\n"))
-			},
-		},
+// handle_parse_error reports malformed or oversized requests with the
+// appropriate status instead of tearing down the process; a nil-ish
+// i/o error (client gone, deadline hit) is a normal way for a
+// keep-alive connection to end, so it's not reported at all.
+func (server *Server) handle_parse_error(conn net.Conn, err error) {
+	switch {
+	case errors.Is(err, ErrLengthRequired):
+		conn.Write([]byte("HTTP/1.1 411 Length Required\r\nConnection: close\r\n\r\n"))
+	case errors.Is(err, ErrRequestTooLarge):
+		conn.Write([]byte("HTTP/1.1 413 Content Too Large\r\nConnection: close\r\n\r\n"))
+	case errors.Is(err, ErrBadRequest):
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n"))
 	}
+}
 
-	for _, route := range mux {
-		re := regexp.MustCompile(route.pattern)
-		inputs := re.FindStringSubmatch(request.path)
-		if re.MatchString(request.path) && request.method == route.method {
-			route.handler(inputs)
-			return
+// should_keep_alive applies RFC 7230 §6.3 defaults: HTTP/1.1 connections
+// stay open unless "Connection: close" is sent, HTTP/1.0 connections
+// close unless "Connection: keep-alive" is sent.
+func should_keep_alive(request Request) bool {
+	connection, err := request.try_get_header("Connection")
+	if err == nil {
+		switch {
+		case strings.EqualFold(strings.TrimSpace(connection), "close"):
+			return false
+		case strings.EqualFold(strings.TrimSpace(connection), "keep-alive"):
+			return true
 		}
 	}
 
-	// Default case
-	log.Println("No route matched, returning 404")
-	conn.Write([]byte("HTTP/1.1 404 Not Found\r\n\r\n"))
+	return request.http_version == "HTTP/1.1"
 }
 
-func extract_path(request string) string {
-	return strings.Split(request, " ")[1]
+// write_status writes a bodyless response with just a status line and
+// a Connection header reflecting whether the connection will be reused.
+func write_status(conn net.Conn, status string, keep_alive bool) {
+	conn.Write([]byte(fmt.Sprintf("HTTP/1.1 %s\r\nConnection: %s\r\n\r\n", status, connection_header(keep_alive))))
+}
+
+func connection_header(keep_alive bool) string {
+	if keep_alive {
+		return "keep-alive"
+	}
+	return "close"
 }